@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Backend abstracts the filesystem operations Backup needs to read a
+// source and write a destination, in the spirit of io/fs.FS extended
+// with the write operations of an afero.Fs. The same interface serves
+// both sides: a read-only backend used as a source (such as FSBackend)
+// simply returns an error from its write-side methods, which Backup
+// never calls on a source.
+type Backend interface {
+	Stat(name string) (fs.FileInfo, error)
+	WalkDir(root string, fn fs.WalkDirFunc)
+	Open(name string) (io.ReadCloser, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Chmod(name string, mode fs.FileMode) error
+
+	// Create opens name for writing. info is the source file's
+	// fs.FileInfo when the write is a file copy, and nil for writes
+	// that don't originate from a source file (e.g. a digest
+	// manifest); backends that don't need it may ignore it.
+	Create(name string, info fs.FileInfo) (io.WriteCloser, error)
+
+	Chtimes(name string, mtime time.Time) error
+
+	// RemoveAll removes path and, if it is a directory, everything
+	// under it, in the spirit of os.RemoveAll.
+	RemoveAll(path string) error
+}
+
+// fastCopier lets a backend offer an accelerated same-kind copy, used
+// only when the destination backend supports it (e.g. the OS backend
+// on Windows using CopyFileW). copyBetween falls back to the generic
+// Open/Create path whenever it isn't available or declines to handle
+// the pair.
+type fastCopier interface {
+	fastCopy(src Backend, srcPath, destPath string, srcInfo fs.FileInfo) (done bool, err error)
+}
+
+// Copies srcPath from src to destPath on dst, setting the destination's
+// permissions to 0660 and its modification time to srcInfo's.
+func copyBetween(src, dst Backend, srcPath, destPath string, srcInfo fs.FileInfo) error {
+	if fc, ok := dst.(fastCopier); ok {
+		if done, err := fc.fastCopy(src, srcPath, destPath, srcInfo); done {
+			return err
+		}
+	}
+
+	r, err := src.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("cannot open %q for reading: %w", srcPath, err)
+	}
+	defer r.Close()
+
+	w, err := dst.Create(destPath, srcInfo)
+	if err != nil {
+		return fmt.Errorf("cannot open %q for writing: %w", destPath, err)
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("error copying content of %q: %w", srcPath, err)
+	}
+
+	dst.Chmod(destPath, 0660)
+	dst.Chtimes(destPath, srcInfo.ModTime())
+	return nil
+}
@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrReadOnly is returned by the write-side methods of read-only
+// backends such as FSBackend.
+var ErrReadOnly = errors.New("backend is read-only")
+
+// FSBackend adapts a read-only io/fs.FS into a Backend, so Backup can
+// read its source out of an embed.FS, a zip archive, or any other
+// fs.FS implementation (e.g. an SFTP-mounted filesystem). It is only
+// ever valid as a source: its write-side methods return ErrReadOnly,
+// which Backup never calls on a source backend.
+type FSBackend struct {
+	FS fs.FS
+}
+
+// NewFSBackend wraps fsys as a read-only source Backend.
+func NewFSBackend(fsys fs.FS) FSBackend {
+	return FSBackend{FS: fsys}
+}
+
+func (b FSBackend) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(b.FS, toFSPath(name))
+}
+
+func (b FSBackend) WalkDir(root string, fn fs.WalkDirFunc) {
+	fs.WalkDir(b.FS, toFSPath(root), func(path string, d fs.DirEntry, err error) error {
+		return fn(fromFSPath(path), d, err)
+	})
+}
+
+func (b FSBackend) Open(name string) (io.ReadCloser, error) {
+	return b.FS.Open(toFSPath(name))
+}
+
+func (b FSBackend) MkdirAll(path string, perm fs.FileMode) error {
+	return ErrReadOnly
+}
+
+func (b FSBackend) Chmod(name string, mode fs.FileMode) error {
+	return ErrReadOnly
+}
+
+func (b FSBackend) Create(name string, info fs.FileInfo) (io.WriteCloser, error) {
+	return nil, ErrReadOnly
+}
+
+func (b FSBackend) Chtimes(name string, mtime time.Time) error {
+	return ErrReadOnly
+}
+
+func (b FSBackend) RemoveAll(path string) error {
+	return ErrReadOnly
+}
+
+// io/fs.FS paths are always slash-separated and rooted without a
+// leading slash; toFSPath adapts the OS-style paths Backup works with.
+func toFSPath(name string) string {
+	name = strings.TrimPrefix(filepath.ToSlash(name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// fromFSPath reverses toFSPath on the paths WalkDir hands back from
+// fs.WalkDir, restoring the leading separator that the rest of Backup
+// (handleFile's destPath concatenation in particular) expects.
+func fromFSPath(name string) string {
+	if name == "." {
+		return string(filepath.Separator)
+	}
+	return string(filepath.Separator) + filepath.FromSlash(name)
+}
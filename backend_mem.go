@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memEntry implements both fs.FileInfo and fs.DirEntry for an entry
+// held by a MemBackend.
+type memEntry struct {
+	key     string
+	isDir   bool
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+func (e *memEntry) Name() string               { return filepath.Base(e.key) }
+func (e *memEntry) Size() int64                { return e.size }
+func (e *memEntry) Mode() fs.FileMode          { return e.mode }
+func (e *memEntry) ModTime() time.Time         { return e.modTime }
+func (e *memEntry) IsDir() bool                { return e.isDir }
+func (e *memEntry) Sys() any                   { return nil }
+func (e *memEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e *memEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+// MemBackend is an in-memory Backend, used in place of the previous
+// global-variable mocking to unit test Backup without touching the
+// real filesystem. Its methods are safe for concurrent use, so it can
+// back either side of a parallel (!P) run.
+type MemBackend struct {
+	mu      sync.Mutex
+	entries map[string]*memEntry
+
+	mkdirErr  map[string]error
+	createErr map[string]error
+}
+
+// NewMemBackend returns an empty in-memory backend.
+func NewMemBackend() *MemBackend {
+	return &MemBackend{entries: map[string]*memEntry{}}
+}
+
+func (b *MemBackend) key(name string) string {
+	return strings.TrimSuffix(filepath.ToSlash(name), "/")
+}
+
+// AddDir adds an empty directory (and any missing ancestor directories)
+// to the backend.
+func (b *MemBackend) AddDir(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ensureDirLocked(name)
+}
+
+// AddFile adds a file (and any missing ancestor directories) to the
+// backend.
+func (b *MemBackend) AddFile(name string, size int64, modTime time.Time, mode fs.FileMode, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := b.key(name)
+	b.ensureDirLocked(filepath.Dir(name))
+	b.entries[k] = &memEntry{key: k, size: size, mode: mode, modTime: modTime, data: data}
+}
+
+// FailMkdirAll makes a future MkdirAll call for path fail with err.
+func (b *MemBackend) FailMkdirAll(path string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mkdirErr == nil {
+		b.mkdirErr = map[string]error{}
+	}
+	b.mkdirErr[b.key(path)] = err
+}
+
+// FailCreate makes a future Create call for name fail with err.
+func (b *MemBackend) FailCreate(name string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.createErr == nil {
+		b.createErr = map[string]error{}
+	}
+	b.createErr[b.key(name)] = err
+}
+
+// ensureDirLocked creates name (and any missing ancestor directories)
+// as a directory entry. Callers must hold b.mu.
+func (b *MemBackend) ensureDirLocked(name string) {
+	k := b.key(name)
+	if k == "" || k == "." {
+		return
+	}
+	if e, ok := b.entries[k]; ok {
+		e.isDir = true
+		return
+	}
+	b.entries[k] = &memEntry{key: k, isDir: true}
+	b.ensureDirLocked(filepath.Dir(name))
+}
+
+func (b *MemBackend) Stat(name string) (fs.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[b.key(name)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	c := *e
+	return &c, nil
+}
+
+func (b *MemBackend) WalkDir(root string, fn fs.WalkDirFunc) {
+	rootKey := b.key(root)
+
+	b.mu.Lock()
+	var keys []string
+	for k := range b.entries {
+		if k == rootKey || strings.HasPrefix(k, rootKey+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	snapshot := make(map[string]*memEntry, len(keys))
+	for _, k := range keys {
+		c := *b.entries[k]
+		snapshot[k] = &c
+	}
+	b.mu.Unlock()
+
+	var skipPrefix string
+	for _, k := range keys {
+		if skipPrefix != "" && strings.HasPrefix(k, skipPrefix) {
+			continue
+		}
+		e := snapshot[k]
+		err := fn(filepath.FromSlash(k), e, nil)
+		if err == fs.SkipDir {
+			if e.isDir {
+				skipPrefix = k + "/"
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *MemBackend) Open(name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	e, ok := b.entries[b.key(name)]
+	var data []byte
+	if ok {
+		data = e.data
+	}
+	b.mu.Unlock()
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *MemBackend) MkdirAll(path string, perm fs.FileMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.mkdirErr[b.key(path)]; err != nil {
+		return err
+	}
+	b.ensureDirLocked(path)
+	return nil
+}
+
+func (b *MemBackend) Chmod(name string, mode fs.FileMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.entries[b.key(name)]; ok {
+		e.mode = mode
+	}
+	return nil
+}
+
+func (b *MemBackend) Create(name string, info fs.FileInfo) (io.WriteCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := b.key(name)
+	if err := b.createErr[k]; err != nil {
+		return nil, err
+	}
+	b.ensureDirLocked(filepath.Dir(name))
+	// Register the entry now, rather than on Close, so a Chmod/Chtimes
+	// call made between Create and Close (as copyBetween does) lands on
+	// it instead of silently no-op'ing against a not-yet-existing key.
+	b.entries[k] = &memEntry{key: k}
+	return &memWriter{backend: b, key: k}, nil
+}
+
+func (b *MemBackend) Chtimes(name string, mtime time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.entries[b.key(name)]; ok {
+		e.modTime = mtime
+	}
+	return nil
+}
+
+func (b *MemBackend) RemoveAll(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := b.key(path)
+	delete(b.entries, k)
+	prefix := k + "/"
+	for ek := range b.entries {
+		if strings.HasPrefix(ek, prefix) {
+			delete(b.entries, ek)
+		}
+	}
+	return nil
+}
+
+// memWriter buffers writes in memory until Close commits them as a
+// file entry on its backend.
+type memWriter struct {
+	backend *MemBackend
+	key     string
+	buf     bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriter) Close() error {
+	w.backend.mu.Lock()
+	defer w.backend.mu.Unlock()
+	e, ok := w.backend.entries[w.key]
+	if !ok {
+		e = &memEntry{key: w.key}
+		w.backend.entries[w.key] = e
+	}
+	e.size = int64(w.buf.Len())
+	e.data = w.buf.Bytes()
+	return nil
+}
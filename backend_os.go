@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OSBackend is the default Backend, operating directly on the local
+// filesystem through the os and path/filepath packages.
+type OSBackend struct{}
+
+func (OSBackend) Stat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (OSBackend) WalkDir(root string, fn fs.WalkDirFunc) {
+	filepath.WalkDir(root, fn)
+}
+
+func (OSBackend) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (OSBackend) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSBackend) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (OSBackend) Create(name string, info fs.FileInfo) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (OSBackend) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(name, time.Now(), mtime)
+}
+
+func (OSBackend) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"io/fs"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel        *windows.LazyDLL
+	procCopyFileW *windows.LazyProc
+)
+
+func init() {
+	kernel = windows.NewLazySystemDLL("kernel32")
+	procCopyFileW = kernel.NewProc("CopyFileW")
+	destDirPerm = 0777
+}
+
+// fastCopy accelerates an OSBackend-to-OSBackend copy using CopyFileW,
+// which preserves more of the source file's attributes than a generic
+// Open/Create/io.Copy round trip. It declines (done=false) whenever the
+// source isn't also the OS backend, falling back to the generic path.
+func (OSBackend) fastCopy(src Backend, srcPath, destPath string, srcInfo fs.FileInfo) (bool, error) {
+	if _, ok := src.(OSBackend); !ok {
+		return false, nil
+	}
+
+	lpcwstrSrc, err := windows.UTF16PtrFromString(srcPath)
+	if err != nil {
+		return true, err
+	}
+
+	lpcwstrDest, err := windows.UTF16PtrFromString(destPath)
+	if err != nil {
+		return true, err
+	}
+
+	r1, _, err := procCopyFileW.Call(
+		uintptr(unsafe.Pointer(lpcwstrSrc)),
+		uintptr(unsafe.Pointer(lpcwstrDest)),
+		uintptr(uint32(0)),
+	)
+
+	if r1 == 0 {
+		return true, err
+	}
+	return true, nil
+}
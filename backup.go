@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,11 +21,16 @@ var (
 
 	isWin             = runtime.GOOS == "windows"
 	commentRex        = regexp.MustCompile(`^#`)
+	archiveTargetRex  = regexp.MustCompile(`^=>@\s*(.*)`)
 	targetRex         = regexp.MustCompile(`^=>\s*(.*)`)
 	maxAgeRex         = regexp.MustCompile(`^!@\s*(.*)\s*$`)
 	maxSizeRex        = regexp.MustCompile(`^!>\s*(.*)\s*$`)
 	excludeRex        = regexp.MustCompile(`^!\s*(.*)`)
 	extendExcludeRex  = regexp.MustCompile(`^!\+\s*(.*)`)
+	digestRex         = regexp.MustCompile(`^!~\s*(.*)`)
+	parallelRex       = regexp.MustCompile(`^!P\s*(.*)\s*$`)
+	retentionRex      = regexp.MustCompile(`^!R\s*(.*)\s*$`)
+	jsonLogRex        = regexp.MustCompile(`^!J\s*(.*)\s*$`)
 	printDotFileCount = 100
 	maxErrors         = 100
 )
@@ -33,12 +39,36 @@ var (
 type backupContext struct {
 	out        io.Writer
 	dryRun     bool
+	src        Backend
+	dst        Backend
 	targetPath string
 	startDate  time.Time
 	maxSize    int64
 	exclude    []*regexp.Regexp
 	count      backupCounts
 	msgs       []string
+
+	digestAll     bool
+	digestScopes  []*regexp.Regexp
+	manifest      digestManifest
+	digestIndex   map[string]string
+	manifestOnce  sync.Once
+	manifestDirty bool
+
+	parallelism int
+	mu          sync.Mutex
+	outCh       chan string
+
+	archive io.Closer
+
+	prune           bool
+	keepSnapshots   int
+	snapshotApplied bool
+	seenDest        map[string]struct{}
+
+	jsonLog       io.Writer
+	jsonLogCloser io.Closer
+	rootSummaries map[string]rootCounts
 }
 
 // Stats for a directory source.
@@ -48,24 +78,74 @@ type backupCounts struct {
 	copied int
 }
 
-// Invoke this function to perform a backup.
-// config contains lines of configuration, out is a writer to send output
-// messages to, and dryRun turns on dry-run mode.
+// Invoke this function to perform a backup. config contains lines of
+// configuration, out is a writer to send output messages to, and
+// dryRun turns on dry-run mode. Both source and destination are the
+// local OS filesystem; use BackupWithBackend to back up to or from
+// something else.
 //
 // See details at https://github.com/borsosl/go-local-backup/README.md
-func Backup(config []string, out io.Writer, dryRun bool) (ev error) {
+func Backup(config []string, out io.Writer, dryRun bool) error {
+	return BackupWithBackend(config, out, dryRun, OSBackend{}, OSBackend{})
+}
+
+// BackupWithBackend is like Backup, but reads from src and writes to
+// dst instead of assuming the local OS filesystem on both sides. This
+// allows backing up out of a read-only io/fs.FS (via FSBackend) or
+// into an in-memory backend for tests (via MemBackend), without
+// patching any global state.
+func BackupWithBackend(config []string, out io.Writer, dryRun bool, src, dst Backend) error {
+	return BackupWithOptions(config, out, dryRun, src, dst, Options{})
+}
+
+// Options carries settings for BackupWithOptions that don't fit the
+// plain Backup/BackupWithBackend parameter lists.
+type Options struct {
+	// JSONLog, when set, receives the same JSON-lines event stream as
+	// the "!J <path>" config directive (see logEvent), without
+	// requiring the destination Backend to be able to Create a file at
+	// a path. If both are set, whichever is processed last wins, as
+	// with any other config directive appearing more than once. Unlike
+	// a log opened via "!J", JSONLog is never closed by Backup.
+	JSONLog io.Writer
+}
+
+// BackupWithOptions is like BackupWithBackend, but also accepts
+// Options for settings that have no equivalent config directive.
+func BackupWithOptions(config []string, out io.Writer, dryRun bool, src, dst Backend, opts Options) (ev error) {
 	ev = nil
 	ctx := backupContext{
 		out:       out,
 		dryRun:    dryRun,
+		src:       src,
+		dst:       dst,
 		startDate: time.Time{},
 		maxSize:   math.MaxInt64,
+		jsonLog:   opts.JSONLog,
 	}
 
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Fprintln(out, r)
 		}
+		if ctx.archive != nil {
+			if err := ctx.archive.Close(); err != nil {
+				fmt.Fprintln(out, "WARN: cannot close archive:", err)
+			}
+		}
+		if ctx.jsonLog != nil {
+			emitJSON(&ctx, summaryEvent{Event: "summary", Roots: ctx.rootSummaries})
+			if ctx.jsonLogCloser != nil {
+				if err := ctx.jsonLogCloser.Close(); err != nil {
+					fmt.Fprintln(out, "WARN: cannot close JSON log:", err)
+				}
+			}
+		}
+		if ctx.manifestDirty && !ctx.dryRun {
+			if err := saveManifest(&ctx); err != nil {
+				fmt.Fprintln(out, "WARN: cannot write digest manifest:", err)
+			}
+		}
 		if len(ctx.msgs) > 0 {
 			fmt.Fprintf(out, "\n%d errors:\n", len(ctx.msgs))
 			for _, s := range ctx.msgs {
@@ -89,7 +169,7 @@ func Backup(config []string, out io.Writer, dryRun bool) (ev error) {
 		}
 
 		path := line
-		info, err := stat(path)
+		info, err := ctx.src.Stat(path)
 		if err != nil {
 			msg(&ctx, fmt.Sprint("Cannot stat, skipping: ", path))
 			continue
@@ -103,6 +183,13 @@ func Backup(config []string, out io.Writer, dryRun bool) (ev error) {
 		}
 	}
 
+	if ctx.prune {
+		pruneDestination(&ctx)
+	}
+	if ctx.keepSnapshots > 0 {
+		pruneSnapshots(&ctx)
+	}
+
 	return
 }
 
@@ -112,10 +199,17 @@ func processNonPathLine(ctx *backupContext, line string) bool {
 		return true
 	}
 
-	res := targetRex.FindSubmatch([]byte(line))
+	res := archiveTargetRex.FindSubmatch([]byte(line))
+	if res != nil {
+		handleArchiveTarget(ctx, strings.TrimSpace(string(res[1])))
+		return true
+	}
+
+	res = targetRex.FindSubmatch([]byte(line))
 	if res != nil {
 		ctx.targetPath = strings.TrimSuffix(string(res[1]), string(filepath.Separator))
 		fmt.Fprintln(ctx.out, "target", ctx.targetPath)
+		applySnapshotDir(ctx)
 		return true
 	}
 
@@ -146,6 +240,37 @@ func processNonPathLine(ctx *backupContext, line string) bool {
 		return true
 	}
 
+	res = digestRex.FindSubmatch([]byte(line))
+	if res != nil {
+		parseDigestScope(ctx, string(res[1]))
+		fmt.Fprintln(ctx.out, "digest", string(res[1]))
+		return true
+	}
+
+	res = parallelRex.FindSubmatch([]byte(line))
+	if res != nil {
+		n, err := strconv.Atoi(strings.TrimSpace(string(res[1])))
+		if err != nil || n < 1 {
+			fmt.Fprintf(ctx.out, "WARN: Expected a positive number in: %s\n", line)
+		} else {
+			ctx.parallelism = n
+			fmt.Fprintln(ctx.out, "parallelism", ctx.parallelism)
+		}
+		return true
+	}
+
+	res = retentionRex.FindSubmatch([]byte(line))
+	if res != nil {
+		parseRetention(ctx, string(res[1]))
+		return true
+	}
+
+	res = jsonLogRex.FindSubmatch([]byte(line))
+	if res != nil {
+		parseJSONLog(ctx, string(res[1]))
+		return true
+	}
+
 	res = extendExcludeRex.FindSubmatch([]byte(line))
 	if res != nil {
 		parseExclude(ctx, string(res[1]), true)
@@ -163,6 +288,30 @@ func processNonPathLine(ctx *backupContext, line string) bool {
 	return false
 }
 
+// Makes the destination a single streaming tar (or tar.gz, for a
+// ".gz"/".tgz" path) archive instead of a mirrored directory tree. In
+// dry-run mode the real archive is never opened; handleFile already
+// lists would-be members without calling ctx.dst.Create.
+func handleArchiveTarget(ctx *backupContext, archivePath string) {
+	ctx.targetPath = archivePath
+	fmt.Fprintln(ctx.out, "target (archive)", ctx.targetPath)
+
+	if ctx.dryRun {
+		ctx.dst = archiveDryRunBackend{}
+		return
+	}
+
+	w, err := ctx.dst.Create(archivePath, nil)
+	if err != nil {
+		msg(ctx, fmt.Sprint("Cannot open archive for writing: ", archivePath))
+		return
+	}
+	gzipped := strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz")
+	archive := NewArchiveBackend(archivePath, w, gzipped)
+	ctx.dst = archive
+	ctx.archive = archive
+}
+
 // Collects active regular expressions for exclusion.
 func parseExclude(ctx *backupContext, arg string, extend bool) {
 	if !extend {
@@ -183,14 +332,71 @@ func parseExclude(ctx *backupContext, arg string, extend bool) {
 	}
 }
 
+// Enables content-digest based change detection, either for every file
+// (bare "!~") or scoped to paths matching a "**"-aware wildcard pattern.
+func parseDigestScope(ctx *backupContext, arg string) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		ctx.digestAll = true
+		return
+	}
+	rex, err := globToRegexp(arg)
+	if err != nil {
+		msg(ctx, fmt.Sprintf("Error in digest pattern: %s", arg))
+		return
+	}
+	ctx.digestScopes = append(ctx.digestScopes, rex)
+}
+
+// Enables post-run cleanup of the destination, either pruning
+// destination entries that no source file accepted in this run maps to
+// ("prune") or, combined with a snapshot
+// target, capping the number of kept snapshot directories ("keep=<n>").
+func parseRetention(ctx *backupContext, arg string) {
+	arg = strings.TrimSpace(arg)
+	switch {
+	case arg == "prune":
+		ctx.prune = true
+		fmt.Fprintln(ctx.out, "prune orphaned destination files")
+	case strings.HasPrefix(arg, "keep="):
+		n, err := strconv.Atoi(strings.TrimPrefix(arg, "keep="))
+		if err != nil || n < 1 {
+			msg(ctx, fmt.Sprintf("Expected a positive number in: !R %s", arg))
+			return
+		}
+		ctx.keepSnapshots = n
+		fmt.Fprintln(ctx.out, "keep snapshots", n)
+		applySnapshotDir(ctx)
+	default:
+		msg(ctx, fmt.Sprintf("Unknown retention directive: !R %s", arg))
+	}
+}
+
+// Once both a target path and a keepSnapshots count are known, turns
+// the target into a fresh timestamped snapshot directory under it, so
+// pruneSnapshots has siblings to compare against on later runs.
+func applySnapshotDir(ctx *backupContext) {
+	if ctx.keepSnapshots == 0 || ctx.snapshotApplied || ctx.targetPath == "" {
+		return
+	}
+	ctx.snapshotApplied = true
+	ctx.targetPath = filepath.Join(ctx.targetPath, time.Now().Format("20060102-150405"))
+	fmt.Fprintln(ctx.out, "snapshot target", ctx.targetPath)
+}
+
 // Recurses a source directory, filters excluded subdirectories.
 func handleDir(ctx *backupContext, path string) {
 	ctx.count = backupCounts{}
+	if ctx.parallelism > 1 {
+		handleDirParallel(ctx, path)
+		return
+	}
 	walkCallback := func(path string, d fs.DirEntry, err error) error {
 		if d.IsDir() {
 			path += string(filepath.Separator)
 			for _, rex := range ctx.exclude {
 				if rex.MatchString(path) {
+					emitJSON(ctx, logEvent{Event: "skip", Src: path, Reason: "excluded"})
 					return fs.SkipDir
 				}
 			}
@@ -203,52 +409,85 @@ func handleDir(ctx *backupContext, path string) {
 		}
 		return nil
 	}
-	walkDir(path, walkCallback)
+	ctx.src.WalkDir(path, walkCallback)
 	if ctx.count.files >= printDotFileCount {
 		fmt.Fprintln(ctx.out)
 	}
 	fmt.Fprintf(ctx.out, "Dirs: %d, Files: %d, Copied: %d\n",
 		ctx.count.dir, ctx.count.files, ctx.count.copied)
+	recordRootSummary(ctx, path)
 }
 
 // Copies a file if not filtered.
 func handleFile(ctx *backupContext, srcPath string, srcInfo fs.FileInfo) {
-	ctx.count.files++
-	if !ctx.dryRun && ctx.count.files%printDotFileCount == 0 {
-		fmt.Fprint(ctx.out, ".")
+	if n := countFiles(ctx); !ctx.dryRun && n%printDotFileCount == 0 {
+		writeOut(ctx, ".")
 	}
 
 	if srcInfo.Mode()&fs.ModeSymlink != 0 {
+		emitJSON(ctx, logEvent{Event: "skip", Src: srcPath, Reason: "symlink"})
 		return
 	}
 
 	if srcInfo.Size() > ctx.maxSize {
+		emitJSON(ctx, logEvent{Event: "skip", Src: srcPath, Reason: "too_large"})
 		return
 	}
 
 	if srcInfo.ModTime().Before(ctx.startDate) {
+		emitJSON(ctx, logEvent{Event: "skip", Src: srcPath, Reason: "too_old"})
 		return
 	}
 
 	for _, rex := range ctx.exclude {
 		if rex.MatchString(srcPath) {
+			emitJSON(ctx, logEvent{Event: "skip", Src: srcPath, Reason: "excluded"})
 			return
 		}
 	}
 
 	vol := filepath.VolumeName(srcPath)
 	destPath := ctx.targetPath + srcPath[len(vol):]
+	markSeen(ctx, destPath)
 
-	destInfo, err := stat(destPath)
+	destInfo, err := ctx.dst.Stat(destPath)
 	if err == nil {
 		if !destInfo.ModTime().Before(srcInfo.ModTime()) {
+			emitJSON(ctx, logEvent{Event: "skip", Src: srcPath, Dst: destPath, Reason: "up_to_date"})
 			return
 		}
+		if digestEnabled(ctx, srcPath) {
+			unchanged, err := checkDigest(ctx, srcPath, destPath, srcInfo)
+			if err != nil {
+				msg(ctx, err.Error())
+				return
+			}
+			if unchanged {
+				emitJSON(ctx, logEvent{Event: "skip", Src: srcPath, Dst: destPath, Reason: "up_to_date"})
+				return
+			}
+		}
 		if isWin && destInfo.Mode()&0200 != 0 {
-			chmod(destPath, destDirPerm)
+			ctx.dst.Chmod(destPath, destDirPerm)
 		}
 	} else if !ctx.dryRun {
-		err := mkdirAll(filepath.Dir(destPath), destDirPerm)
+		if digestEnabled(ctx, srcPath) {
+			deduped, err := dedupeByDigest(ctx, srcPath, destPath, srcInfo)
+			if err != nil {
+				msg(ctx, err.Error())
+				return
+			}
+			if deduped {
+				mtime := srcInfo.ModTime()
+				emitJSON(ctx, logEvent{
+					Event: "copy", Src: srcPath, Dst: destPath,
+					Size: srcInfo.Size(), MTime: &mtime, BytesCopied: srcInfo.Size(),
+				})
+				countCopied(ctx)
+				return
+			}
+		}
+		err := ctx.dst.MkdirAll(filepath.Dir(destPath), destDirPerm)
 		if err != nil {
 			msg(ctx, fmt.Sprint("Cannot create dirs for: ", destPath))
 			return
@@ -256,24 +495,101 @@ func handleFile(ctx *backupContext, srcPath string, srcInfo fs.FileInfo) {
 	}
 
 	if ctx.dryRun {
-		fmt.Fprintln(ctx.out, srcPath)
-		ctx.count.copied++
+		writeOut(ctx, srcPath+"\n")
+		countCopied(ctx)
 		return
 	}
 
-	err = copy(srcPath, destPath, srcInfo)
+	err = copyBetween(ctx.src, ctx.dst, srcPath, destPath, srcInfo)
 	if err != nil {
 		msg(ctx, err.Error())
 		return
 	}
 
-	ctx.count.copied++
+	mtime := srcInfo.ModTime()
+	emitJSON(ctx, logEvent{
+		Event: "copy", Src: srcPath, Dst: destPath,
+		Size: srcInfo.Size(), MTime: &mtime, BytesCopied: srcInfo.Size(),
+	})
+	countCopied(ctx)
 }
 
 // Adds to collected messages that are printed after sources are processed.
 func msg(ctx *backupContext, msg string) {
-	ctx.msgs = append(ctx.msgs, msg)
-	if len(ctx.msgs) >= maxErrors {
+	ctx.mu.Lock()
+	capReached := false
+	if len(ctx.msgs) < maxErrors {
+		ctx.msgs = append(ctx.msgs, msg)
+		capReached = len(ctx.msgs) >= maxErrors
+	}
+	ctx.mu.Unlock()
+
+	emitJSON(ctx, logEvent{Event: "error", Error: msg})
+
+	if capReached {
 		panic("Quitting due to too many errors!")
 	}
 }
+
+// Increments the processed-files counter and returns its new value.
+// Safe to call from multiple worker goroutines.
+func countFiles(ctx *backupContext) int {
+	ctx.mu.Lock()
+	ctx.count.files++
+	n := ctx.count.files
+	ctx.mu.Unlock()
+	return n
+}
+
+// Increments the copied-files counter. Safe to call from multiple
+// worker goroutines.
+func countCopied(ctx *backupContext) {
+	ctx.mu.Lock()
+	ctx.count.copied++
+	ctx.mu.Unlock()
+}
+
+// Records that destPath corresponds to a file still present in the
+// source, so pruneDestination knows not to remove it. A no-op unless
+// pruning was enabled via "!R prune". Safe to call from multiple
+// worker goroutines.
+func markSeen(ctx *backupContext, destPath string) {
+	if !ctx.prune {
+		return
+	}
+	ctx.mu.Lock()
+	if ctx.seenDest == nil {
+		ctx.seenDest = map[string]struct{}{}
+	}
+	ctx.seenDest[destPath] = struct{}{}
+	ctx.mu.Unlock()
+}
+
+// Records a finished directory root's counts for the final JSON
+// summary event. A no-op unless a JSON log is enabled via "!J" or
+// Options.JSONLog.
+func recordRootSummary(ctx *backupContext, path string) {
+	if ctx.jsonLog == nil {
+		return
+	}
+	ctx.mu.Lock()
+	if ctx.rootSummaries == nil {
+		ctx.rootSummaries = map[string]rootCounts{}
+	}
+	ctx.rootSummaries[path] = rootCounts{
+		Dirs: ctx.count.dir, Files: ctx.count.files, Copied: ctx.count.copied,
+	}
+	ctx.mu.Unlock()
+}
+
+// Writes a progress fragment to ctx.out. When ctx.outCh is set (during
+// a parallel directory walk), the write is routed through the single
+// goroutine draining it instead, so concurrent workers can't interleave
+// their output mid-write.
+func writeOut(ctx *backupContext, s string) {
+	if ctx.outCh != nil {
+		ctx.outCh <- s
+		return
+	}
+	fmt.Fprint(ctx.out, s)
+}
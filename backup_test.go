@@ -1,16 +1,23 @@
 package backup
 
 import (
+	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
 	"io/fs"
-	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
+// fileAttr describes one source file to seed into a test's MemBackend,
+// and whether it is expected to end up copied.
 type fileAttr struct {
 	path   string
 	age    int
@@ -41,14 +48,6 @@ var pathsErrors = []*fileAttr{
 	{"/er1/d1/f2", 10, 100, false, "mkdirs fails when target file missing"},
 }
 
-var walkedDirs = map[string][]string{
-	"/d1":    {"/d1/d2", "/d1/d2/f1", "/d1/d2/s1"},
-	"/d3/d4": {"/d3/d4/f1", "/d3/d4/f2", "/d3/d4/f3", "/d3/d4/f4"},
-	"/d5":    {"/d5/f1", "/d5/f5", "/d5/d6", "/d5/d6/f1"},
-	"/d7":    {"/d7/d_has_middle_part", "/d7/d_has_middle_part/f1"},
-	"/er1":   {"/er1/f1", "/er1/d1/f2"},
-}
-
 var configNoErrors = `
 => /backup
 
@@ -78,38 +77,34 @@ var configNoTarget = `
 /any_source
 `
 
-var testStart = func() time.Time {
-	// override isTest as part of var initialization, before init()
-	isTest = true
-	return time.Now()
-}()
-
-var attrMap map[string]*fileAttr
-var copiedFiles map[string]bool
-
-// fileAttr implements fs.FileInfo and fs.DirEntry
-func (fa *fileAttr) Name() string { return fa.path }
-func (fa *fileAttr) Size() int64  { return fa.size }
-func (fa *fileAttr) IsDir() bool  { return fa.size == -1 }
-func (fa *fileAttr) Sys() any     { return nil }
-func (fa *fileAttr) ModTime() time.Time {
-	return testStart.Add(-time.Duration(fa.age*24) * time.Hour)
+var testStart = time.Now()
+
+func ageTime(days int) time.Time {
+	return testStart.Add(-time.Duration(days*24) * time.Hour)
 }
-func (fa *fileAttr) Mode() fs.FileMode {
-	if fa.path == "/backup/d1/d2/f1" {
-		return 0200
-	}
-	if strings.HasSuffix(fa.path, "/s1") {
-		return fs.ModeSymlink
+
+// recordingBackend wraps a Backend and remembers every path that was
+// written through Create, so tests can assert on what got copied
+// without the previous global-variable mocking.
+type recordingBackend struct {
+	Backend
+	created map[string]bool
+}
+
+func (b *recordingBackend) Create(name string, info fs.FileInfo) (io.WriteCloser, error) {
+	w, err := b.Backend.Create(name, info)
+	if err == nil {
+		if b.created == nil {
+			b.created = map[string]bool{}
+		}
+		b.created[name] = true
 	}
-	return 0
+	return w, err
 }
-func (fa *fileAttr) Type() fs.FileMode          { return fa.Mode() }
-func (fa *fileAttr) Info() (fs.FileInfo, error) { return fa, nil }
 
 func TestBackup_NoErrors(t *testing.T) {
 	printDotFileCount = 2
-	_, err := testBackup(t, pathsNoErrors, configNoErrors, false)
+	_, err := testBackup(t, pathsNoErrors, configNoErrors, false, buildNoErrorsBackends)
 	if err != nil {
 		t.Errorf("Expected no errors")
 	}
@@ -117,7 +112,7 @@ func TestBackup_NoErrors(t *testing.T) {
 }
 
 func TestBackup_Errors(t *testing.T) {
-	_, err := testBackup(t, pathsErrors, configErrors, false)
+	_, err := testBackup(t, pathsErrors, configErrors, false, buildErrorsBackends)
 	if err == nil {
 		t.Errorf("Expected errors")
 	}
@@ -128,7 +123,7 @@ func TestBackup_Errors(t *testing.T) {
 
 func TestBackup_TooManyErrors(t *testing.T) {
 	maxErrors = 2
-	_, err := testBackup(t, pathsErrors, configErrors, false)
+	_, err := testBackup(t, pathsErrors, configErrors, false, buildErrorsBackends)
 	if err == nil {
 		t.Errorf("Expected errors")
 	}
@@ -139,7 +134,9 @@ func TestBackup_TooManyErrors(t *testing.T) {
 }
 
 func TestBackup_NoTarget(t *testing.T) {
-	_, err := testBackup(t, nil, configNoTarget, false)
+	_, err := testBackup(t, nil, configNoTarget, false, func([]*fileAttr) (*MemBackend, *recordingBackend) {
+		return NewMemBackend(), &recordingBackend{Backend: NewMemBackend()}
+	})
 	if err == nil {
 		t.Errorf("Expected error")
 	}
@@ -148,8 +145,33 @@ func TestBackup_NoTarget(t *testing.T) {
 	}
 }
 
+func TestBackup_Parallel(t *testing.T) {
+	config := "!P 4\n" + configNoErrors
+	_, err := testBackup(t, pathsNoErrors, config, false, buildNoErrorsBackends)
+	if err != nil {
+		t.Errorf("Expected no errors")
+	}
+}
+
+func TestBackup_ParallelTooManyErrors(t *testing.T) {
+	maxErrors = 1
+	config := `
+=> /backup
+!P 2
+/er1
+`
+	_, err := testBackup(t, pathsErrors, config, false, buildErrorsBackends)
+	if err == nil {
+		t.Errorf("Expected errors")
+	}
+	if err.Error() != "1 errors" {
+		t.Errorf("Expected 1 errors, but got %s", err.Error())
+	}
+	maxErrors = 100
+}
+
 func TestBackup_DryRun(t *testing.T) {
-	buf, err := testBackup(t, pathsNoErrors, configNoErrors, true)
+	buf, err := testBackup(t, pathsNoErrors, configNoErrors, true, buildNoErrorsBackends)
 	if err != nil {
 		t.Errorf("Expected no errors")
 	}
@@ -158,126 +180,434 @@ func TestBackup_DryRun(t *testing.T) {
 	}
 }
 
-func testBackup(t *testing.T, paths []*fileAttr, config string, dryRun bool) (*bytes.Buffer, error) {
-	if isWin {
-		config = rewritePaths(config)
+func TestBackup_ArchiveTarget(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 5, ageTime(1), 0, []byte("hello"))
+	src.AddFile("/d1/f2", 5, ageTime(1), 0, []byte("world"))
+
+	dst := NewMemBackend()
+	config := strings.Split("=>@ /out/backup.tar\n/d1", "\n")
+
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
 	}
-	mapAttributes(paths)
-	mockDependencies()
-	copiedFiles = map[string]bool{}
+
+	r, err := dst.Open("/out/backup.tar")
+	if err != nil {
+		t.Fatalf("Expected archive to have been written: %s", err)
+	}
+	tr := tar.NewReader(r)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected tar error: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	want := []string{"d1/f1", "d1/f2"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected archive members %v, got %v", want, names)
+	}
+}
+
+func TestBackup_ArchiveDryRun(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 5, ageTime(1), 0, []byte("hello"))
+
+	dst := &recordingBackend{Backend: NewMemBackend()}
+	config := strings.Split("=>@ /out/backup.tar\n/d1", "\n")
 
 	var out bytes.Buffer
-	conf := strings.Split(config, "\n")
-	err := Backup(conf, &out, dryRun)
+	if err := BackupWithBackend(config, &out, true, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+	if len(dst.created) != 0 {
+		t.Errorf("Expected dry run not to open the archive, but %d writes were recorded", len(dst.created))
+	}
+	if !strings.Contains(out.String(), "/d1/f1") {
+		t.Errorf("Expected dry run to list intended archive members")
+	}
+}
 
-	if dryRun {
-		if len(copiedFiles) != 0 {
-			t.Errorf("Expected no copies on dry run, but %d was copied", len(copiedFiles))
+func TestBackup_FSBackendSource(t *testing.T) {
+	src := fstest.MapFS{
+		"d1/f1": &fstest.MapFile{Data: []byte("hello"), ModTime: ageTime(1)},
+	}
+
+	dst := NewMemBackend()
+	config := strings.Split("=> /backup\n/d1", "\n")
+
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, NewFSBackend(src), dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	r, err := dst.Open("/backup/d1/f1")
+	if err != nil {
+		t.Fatalf("Expected %q to have been copied to /backup/d1/f1: %s", "d1/f1", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading copied file: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Expected copied content %q, got %q", "hello", data)
+	}
+}
+
+func TestBackup_Prune(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 100, ageTime(1), 0, []byte("/d1/f1"))
+
+	dst := NewMemBackend()
+	dst.AddFile("/backup/d1/f1", 100, ageTime(1), 0, []byte("/d1/f1"))
+	dst.AddFile("/backup/d1/orphan", 100, ageTime(1), 0, []byte("gone"))
+	dst.AddFile("/backup/d2/orphan2", 100, ageTime(1), 0, []byte("gone"))
+
+	config := strings.Split("=> /backup\n!R prune\n/d1", "\n")
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	if _, err := dst.Stat("/backup/d1/f1"); err != nil {
+		t.Errorf("Expected /backup/d1/f1 to survive pruning")
+	}
+	if _, err := dst.Stat("/backup/d1/orphan"); err == nil {
+		t.Errorf("Expected /backup/d1/orphan to be pruned")
+	}
+	if _, err := dst.Stat("/backup/d2"); err == nil {
+		t.Errorf("Expected empty /backup/d2 to be pruned along with its orphan")
+	}
+}
+
+func TestBackup_PruneDryRun(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 100, ageTime(1), 0, []byte("/d1/f1"))
+
+	dst := NewMemBackend()
+	dst.AddFile("/backup/d1/f1", 100, ageTime(1), 0, []byte("/d1/f1"))
+	dst.AddFile("/backup/d1/orphan", 100, ageTime(1), 0, []byte("gone"))
+
+	config := strings.Split("=> /backup\n!R prune\n/d1", "\n")
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, true, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	if _, err := dst.Stat("/backup/d1/orphan"); err != nil {
+		t.Errorf("Expected dry run not to remove /backup/d1/orphan")
+	}
+	if !strings.Contains(out.String(), "would prune") {
+		t.Errorf("Expected dry run output to mention pruning")
+	}
+}
+
+func TestBackup_KeepSnapshots(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 100, ageTime(1), 0, []byte("/d1/f1"))
+
+	dst := NewMemBackend()
+	dst.AddFile("/backup/20200101-000000/d1/f1", 100, ageTime(1), 0, []byte("old"))
+	dst.AddFile("/backup/20200102-000000/d1/f1", 100, ageTime(1), 0, []byte("old"))
+
+	config := strings.Split("=> /backup\n!R keep=2\n/d1", "\n")
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	if _, err := dst.Stat("/backup/20200101-000000"); err == nil {
+		t.Errorf("Expected oldest snapshot to be pruned beyond keep=2")
+	}
+	if _, err := dst.Stat("/backup/20200102-000000"); err != nil {
+		t.Errorf("Expected second-oldest snapshot to survive")
+	}
+}
+
+func TestBackup_JSONLog(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 5, ageTime(1), 0, []byte("hello"))
+	src.AddFile("/d1/s1", 0, ageTime(1), fs.ModeSymlink, nil)
+
+	dst := NewMemBackend()
+	config := strings.Split("=> /backup\n!J /backup.log\n/d1", "\n")
+
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	r, err := dst.Open("/backup.log")
+	if err != nil {
+		t.Fatalf("Expected JSON log to have been written: %s", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading JSON log: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var events []map[string]any
+	for _, l := range lines {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("Invalid JSON line %q: %s", l, err)
 		}
-	} else {
-		for _, fa := range paths {
-			if fa.copied && !copiedFiles[fa.path] {
-				t.Errorf("%s: Expected %s to be copied, but it wasn't", fa.tcase, fa.path)
-			} else if !fa.copied && copiedFiles[fa.path] {
-				t.Errorf("%s: Expected %s not to be copied, but it was", fa.tcase, fa.path)
+		events = append(events, e)
+	}
+
+	var sawCopy, sawSkip, sawSummary bool
+	for _, e := range events {
+		switch e["event"] {
+		case "copy":
+			sawCopy = true
+		case "skip":
+			if e["reason"] == "symlink" {
+				sawSkip = true
+				if _, ok := e["mtime"]; ok {
+					t.Errorf("Expected skip event not to carry an mtime field, got %v", e)
+				}
 			}
+		case "summary":
+			sawSummary = true
 		}
 	}
-	return &out, err
+	if !sawCopy || !sawSkip || !sawSummary {
+		t.Errorf("Expected copy, skip and summary events, got %v", events)
+	}
 }
 
-func rewritePaths(config string) string {
-	configLines := strings.Split(config, "\n")
-	rex := regexp.MustCompile(`( |^)/`)
-	for i, cl := range configLines {
-		if len(cl) == 0 {
-			continue
+func TestBackup_JSONLogOption(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 5, ageTime(1), 0, []byte("hello"))
+
+	dst := NewMemBackend()
+	config := strings.Split("=> /backup\n/d1", "\n")
+
+	var out, jsonLog bytes.Buffer
+	opts := Options{JSONLog: &jsonLog}
+	if err := BackupWithOptions(config, &out, false, src, dst, opts); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	if !strings.Contains(jsonLog.String(), `"event":"copy"`) {
+		t.Errorf("Expected copy event in Options.JSONLog, got %q", jsonLog.String())
+	}
+	if _, err := dst.Stat("/backup.log"); err == nil {
+		t.Errorf("Expected Options.JSONLog not to create a destination file")
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/photos/**/*.jpg", "/photos/2020/vacation/beach.jpg", true},
+		{"/photos/**/*.jpg", "/photos/beach.jpg", true},
+		{"/photos/**/*.jpg", "/photos/beach.png", false},
+		{"/photos/**/*.jpg", "/videos/beach.jpg", false},
+	}
+	for _, c := range cases {
+		rex, err := globToRegexp(c.pattern)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", c.pattern, err)
 		}
-		configLines[i] = rex.ReplaceAllString(cl, "${1}c:\\")
-		if configLines[i][0] == '!' {
-			configLines[i] = strings.ReplaceAll(configLines[i], "/", "\\\\")
+		if rex.MatchString(c.path) != c.match {
+			t.Errorf("%s vs %s: expected match=%v", c.pattern, c.path, c.match)
 		}
 	}
-	return filepath.FromSlash(strings.Join(configLines, "\n"))
 }
 
-func mapAttributes(paths []*fileAttr) {
-	attrMap = make(map[string]*fileAttr, len(paths))
-	for _, e := range paths {
-		attrMap[e.path] = e
+func TestDigestEnabled(t *testing.T) {
+	ctx := &backupContext{}
+	if digestEnabled(ctx, "/d1/f1") {
+		t.Errorf("digest should be disabled by default")
 	}
-}
 
-func mockDependencies() {
-	stat = statTestImpl
-	walkDir = walkDirTestImpl
-	chmod = func(name string, mode fs.FileMode) error { return nil }
-	mkdirAll = mkdirAllTestImpl
-	copy = copyTestImpl
+	ctx.digestAll = true
+	if !digestEnabled(ctx, "/d1/f1") {
+		t.Errorf("digest should apply to everything when enabled globally")
+	}
+
+	ctx.digestAll = false
+	rex, _ := globToRegexp("/photos/**/*.jpg")
+	ctx.digestScopes = []*regexp.Regexp{rex}
+	if digestEnabled(ctx, "/d1/f1") {
+		t.Errorf("digest should not apply outside configured scope")
+	}
+	if !digestEnabled(ctx, "/photos/2020/beach.jpg") {
+		t.Errorf("digest should apply inside configured scope")
+	}
 }
 
-func statTestImpl(name string) (fs.FileInfo, error) {
-	name = slashify(name)
-	if walkedDirs[name] != nil {
-		return &fileAttr{size: -1}, nil
-	}
-	if strings.HasPrefix(name, "/backup") {
-		srcAttr := attrMap[name[7:]]
-		fa := *srcAttr
-		fa.path = name
-		if strings.HasSuffix(name, "/er1/d1/f2") {
-			return nil, errors.New("target does not exist")
-		} else if !strings.HasSuffix(name, "/d3/d4/f1") {
-			fa.age++
-		}
-		return &fa, nil
+func TestBackup_DigestSkipsTouchedFile(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 5, ageTime(0), 0, []byte("hello"))
+
+	dst := NewMemBackend()
+	dst.AddFile("/backup/d1/f1", 5, ageTime(1), 0, []byte("hello"))
+
+	config := strings.Split("=> /backup\n!~ /d1/*\n/d1", "\n")
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	r := &recordingBackend{Backend: dst}
+	out.Reset()
+	src.AddFile("/d1/f1", 5, ageTime(0).Add(time.Hour), 0, []byte("hello"))
+	if err := BackupWithBackend(config, &out, false, src, r); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
 	}
-	if name == "/nostat" {
-		return nil, errors.New("cannot stat source file")
+	if r.created["/backup/d1/f1"] {
+		t.Errorf("Expected digest-unchanged file not to be recopied after a touch")
+	}
+
+	if _, err := dst.Stat(manifestPath("/backup")); err != nil {
+		t.Errorf("Expected digest manifest to have been written: %s", err)
 	}
-	return attrMap[name], nil
 }
 
-func walkDirTestImpl(root string, callback fs.WalkDirFunc) {
-	path := slashify(root)
-	callback(root, &fileAttr{path, 0, -1, false, ""}, nil)
-	for _, path := range walkedDirs[path] {
-		if attrMap[path] != nil {
-			callback(windowsify(path), attrMap[path], nil)
-		} else {
-			callback(windowsify(path), &fileAttr{path, 0, -1, false, ""}, nil)
-		}
+func TestBackup_DigestDetectsRealChange(t *testing.T) {
+	src := NewMemBackend()
+	src.AddFile("/d1/f1", 5, ageTime(0), 0, []byte("hello"))
+
+	dst := NewMemBackend()
+	dst.AddFile("/backup/d1/f1", 5, ageTime(1), 0, []byte("world"))
+
+	config := strings.Split("=> /backup\n!~ /d1/*\n/d1", "\n")
+	var out bytes.Buffer
+	r := &recordingBackend{Backend: dst}
+	if err := BackupWithBackend(config, &out, false, src, r); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+	if !r.created["/backup/d1/f1"] {
+		t.Errorf("Expected file with changed content to be recopied")
 	}
 }
 
-func mkdirAllTestImpl(path string, perm fs.FileMode) error {
-	path = slashify(path)
-	if path == "/backup/er1/d1" {
-		return errors.New("mkdir failed")
+// openCountingBackend wraps a Backend and counts its Open calls.
+type openCountingBackend struct {
+	Backend
+	opens int
+}
+
+func (b *openCountingBackend) Open(name string) (io.ReadCloser, error) {
+	b.opens++
+	return b.Backend.Open(name)
+}
+
+func TestBackup_DigestDedupesRename(t *testing.T) {
+	mem := NewMemBackend()
+	mem.AddFile("/d1/renamed", 5, ageTime(0), 0, []byte("hello"))
+	src := &openCountingBackend{Backend: mem}
+
+	digest, err := hashFile(mem, "/d1/renamed")
+	if err != nil {
+		t.Fatalf("Unexpected error hashing source file: %s", err)
+	}
+	manifest, err := json.Marshal(digestManifest{
+		"/d1/original": {Size: 5, MTime: ageTime(1), SHA256: digest},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding manifest: %s", err)
+	}
+
+	dst := NewMemBackend()
+	dst.AddFile("/backup/d1/original", 5, ageTime(1), 0, []byte("hello"))
+	dst.AddFile(manifestPath("/backup"), int64(len(manifest)), ageTime(1), 0, manifest)
+
+	config := strings.Split("=> /backup\n!~ /d1/*\n/d1", "\n")
+	var out bytes.Buffer
+	if err := BackupWithBackend(config, &out, false, src, dst); err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	r, err := dst.Open("/backup/d1/renamed")
+	if err != nil {
+		t.Fatalf("Expected renamed destination file: %s", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Unexpected error reading deduped file: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Expected deduped content %q, got %q", "hello", data)
+	}
+	if src.opens != 1 {
+		t.Errorf("Expected renamed file to be hashed but not re-read from source, got %d source reads", src.opens)
 	}
-	return nil
 }
 
-func copyTestImpl(src, dest string, srcInfo fs.FileInfo) error {
-	src = slashify(src)
-	if src == "/er1/f1" {
-		return errors.New("cannot copy")
+// buildNoErrorsBackends seeds a source tree from pathsNoErrors, plus a
+// destination tree pre-populated just enough to exercise the
+// mtime-comparison paths in handleFile.
+func buildNoErrorsBackends(paths []*fileAttr) (*MemBackend, *recordingBackend) {
+	src := NewMemBackend()
+	for _, fa := range paths {
+		var mode fs.FileMode
+		if strings.HasSuffix(fa.path, "/s1") {
+			mode = fs.ModeSymlink
+		}
+		src.AddFile(fa.path, fa.size, ageTime(fa.age), mode, []byte(fa.path))
 	}
-	copiedFiles[src] = true
-	return nil
+
+	dstMem := NewMemBackend()
+	dstMem.AddFile("/backup/d1/d2/f1", 100, ageTime(11), 0200, []byte("stale"))
+	dstMem.AddFile("/backup/d3/d4/f1", 100, ageTime(10), 0, []byte("/d3/d4/f1"))
+
+	return src, &recordingBackend{Backend: dstMem}
 }
 
-func slashify(path string) string {
-	if !isWin {
-		return path
+// buildErrorsBackends seeds pathsErrors, but leaves /nostat out of the
+// source tree and arranges for a failing mkdir and a failing copy.
+func buildErrorsBackends(paths []*fileAttr) (*MemBackend, *recordingBackend) {
+	src := NewMemBackend()
+	for _, fa := range paths {
+		if fa.path == "/nostat" {
+			continue
+		}
+		src.AddFile(fa.path, fa.size, ageTime(fa.age), 0, []byte(fa.path))
 	}
-	vol := filepath.VolumeName(path)
-	return strings.ReplaceAll(path[len(vol):], "\\", "/")
+
+	dstMem := NewMemBackend()
+	dstMem.FailCreate("/backup/er1/f1", errors.New("cannot copy"))
+	dstMem.FailMkdirAll("/backup/er1/d1", errors.New("mkdir failed"))
+
+	return src, &recordingBackend{Backend: dstMem}
 }
 
-func windowsify(path string) string {
-	if !isWin {
-		return path
+func testBackup(t *testing.T, paths []*fileAttr, config string, dryRun bool,
+	build func([]*fileAttr) (*MemBackend, *recordingBackend)) (*bytes.Buffer, error) {
+
+	src, dst := build(paths)
+
+	var out bytes.Buffer
+	conf := strings.Split(config, "\n")
+	err := BackupWithBackend(conf, &out, dryRun, src, dst)
+
+	if dryRun {
+		if len(dst.created) != 0 {
+			t.Errorf("Expected no copies on dry run, but %d was copied", len(dst.created))
+		}
+	} else {
+		for _, fa := range paths {
+			destPath := "/backup" + fa.path
+			if fa.copied && !dst.created[destPath] {
+				t.Errorf("%s: Expected %s to be copied, but it wasn't", fa.tcase, fa.path)
+			} else if !fa.copied && dst.created[destPath] {
+				t.Errorf("%s: Expected %s not to be copied, but it was", fa.tcase, fa.path)
+			}
+		}
 	}
-	return "c:" + filepath.FromSlash(path)
+	return &out, err
 }
@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Name of the sidecar file, kept directly under the target path, that
+// records the content digest of every digest-scoped file that has been
+// copied, deduplicated or compared by content so far.
+const manifestFileName = ".backup-index.json"
+
+// Sidecar record for a single destination file, keyed by its path
+// relative to the target path.
+type digestEntry struct {
+	Size   int64     `json:"size"`
+	MTime  time.Time `json:"mtime"`
+	SHA256 string    `json:"sha256"`
+}
+
+type digestManifest map[string]digestEntry
+
+// Reports whether srcPath falls within the scope of digest-based
+// change detection, either because it was enabled for everything or
+// because it matches one of the configured wildcard scopes.
+func digestEnabled(ctx *backupContext, srcPath string) bool {
+	if ctx.digestAll {
+		return true
+	}
+	if len(ctx.digestScopes) == 0 {
+		return false
+	}
+	p := filepath.ToSlash(srcPath)
+	for _, rex := range ctx.digestScopes {
+		if rex.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines whether srcPath's content already matches what was last
+// recorded for destPath, even though their modification times differ.
+// Updates the in-memory manifest as a side effect so unchanged files
+// don't need re-hashing on the next run. Safe to call from multiple
+// worker goroutines; only the manifest bookkeeping is serialized, not
+// the hashing itself.
+func checkDigest(ctx *backupContext, srcPath, destPath string, srcInfo fs.FileInfo) (bool, error) {
+	loadManifestOnce(ctx)
+	key := manifestKey(ctx, destPath)
+
+	ctx.mu.Lock()
+	entry, known := ctx.manifest[key]
+	ctx.mu.Unlock()
+
+	digest := entry.SHA256
+	if !known || entry.Size != srcInfo.Size() || !entry.MTime.Equal(srcInfo.ModTime()) {
+		d, err := hashFile(ctx.src, srcPath)
+		if err != nil {
+			return false, err
+		}
+		digest = d
+	}
+
+	unchanged := known && entry.SHA256 == digest
+	ctx.mu.Lock()
+	ctx.manifest[key] = digestEntry{Size: srcInfo.Size(), MTime: srcInfo.ModTime(), SHA256: digest}
+	ctx.digestIndex[digest] = key
+	ctx.manifestDirty = true
+	ctx.mu.Unlock()
+	return unchanged, nil
+}
+
+// Looks for a file already present at the destination, anywhere under
+// the scope covered by the manifest, whose content digest matches
+// srcPath's - i.e. srcPath was renamed or moved rather than newly
+// created. When found, populates destPath by copying the existing
+// destination file instead of re-transferring srcPath's content from
+// the source. Either way records destPath's manifest entry; reports
+// false, with no error, when nothing matches so the caller falls back
+// to a normal copy from the source.
+func dedupeByDigest(ctx *backupContext, srcPath, destPath string, srcInfo fs.FileInfo) (bool, error) {
+	loadManifestOnce(ctx)
+
+	digest, err := hashFile(ctx.src, srcPath)
+	if err != nil {
+		return false, err
+	}
+
+	key := manifestKey(ctx, destPath)
+	ctx.mu.Lock()
+	oldKey, known := ctx.digestIndex[digest]
+	ctx.manifest[key] = digestEntry{Size: srcInfo.Size(), MTime: srcInfo.ModTime(), SHA256: digest}
+	ctx.digestIndex[digest] = key
+	ctx.manifestDirty = true
+	ctx.mu.Unlock()
+	if !known {
+		return false, nil
+	}
+
+	oldDestPath := ctx.targetPath + filepath.FromSlash(oldKey)
+	oldInfo, err := ctx.dst.Stat(oldDestPath)
+	if err != nil || oldInfo.Size() != srcInfo.Size() {
+		// Stale manifest entry (the old file is gone, or its content
+		// has since changed): fall back to a normal copy from source.
+		return false, nil
+	}
+
+	if err := ctx.dst.MkdirAll(filepath.Dir(destPath), destDirPerm); err != nil {
+		return false, err
+	}
+	if err := copyWithinDest(ctx.dst, oldDestPath, destPath, srcInfo); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Copies srcPath to destPath within the same (destination) backend,
+// setting permissions to 0660 and the modification time to srcInfo's,
+// the same way copyBetween does across two backends.
+func copyWithinDest(dst Backend, srcPath, destPath string, srcInfo fs.FileInfo) error {
+	r, err := dst.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.Create(destPath, srcInfo)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	dst.Chmod(destPath, 0660)
+	dst.Chtimes(destPath, srcInfo.ModTime())
+	return nil
+}
+
+// Loads the manifest for the current target path, at most once per run.
+func loadManifestOnce(ctx *backupContext) {
+	ctx.manifestOnce.Do(func() {
+		ctx.manifest = digestManifest{}
+		ctx.digestIndex = map[string]string{}
+
+		r, err := ctx.dst.Open(manifestPath(ctx.targetPath))
+		if err == nil {
+			defer r.Close()
+			if data, err := io.ReadAll(r); err == nil {
+				json.Unmarshal(data, &ctx.manifest)
+			}
+		}
+
+		for key, entry := range ctx.manifest {
+			ctx.digestIndex[entry.SHA256] = key
+		}
+	})
+}
+
+// Persists the in-memory manifest back to the target path.
+func saveManifest(ctx *backupContext) error {
+	data, err := json.MarshalIndent(ctx.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := ctx.dst.Create(manifestPath(ctx.targetPath), nil)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, err = w.Write(data)
+	return err
+}
+
+func manifestPath(targetPath string) string {
+	return filepath.Join(targetPath, manifestFileName)
+}
+
+// Streams path through sha256 via src, without loading it fully into
+// memory.
+func hashFile(src Backend, path string) (string, error) {
+	r, err := src.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Key under which a destination file's digest is recorded, relative to
+// the target path so the manifest stays portable across machines.
+func manifestKey(ctx *backupContext, destPath string) string {
+	rel := strings.TrimPrefix(destPath, ctx.targetPath)
+	return filepath.ToSlash(rel)
+}
+
+// Compiles a "**"-aware wildcard pattern (where "**/" matches any number
+// of path segments, a bare "**" matches anything, and "*" matches within
+// a single segment) into a regular expression anchored to the whole path.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		rest := string(runes[i:])
+		switch {
+		case strings.HasPrefix(rest, "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(rest, "**"):
+			sb.WriteString(".*")
+			i++
+		case runes[i] == '*':
+			sb.WriteString("[^/]*")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
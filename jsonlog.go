@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// One line of the optional JSON event log enabled via "!J <path>" or
+// Options.JSONLog. Fields are omitted from a given line when not
+// relevant to its event; size and bytes_copied are also omitted when
+// zero, as for a copy of an empty file.
+type logEvent struct {
+	Event       string     `json:"event"`
+	Src         string     `json:"src,omitempty"`
+	Dst         string     `json:"dst,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	MTime       *time.Time `json:"mtime,omitempty"`
+	BytesCopied int64      `json:"bytes_copied,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Per-source-root counts, reported in the final "summary" event.
+type rootCounts struct {
+	Dirs   int `json:"dirs"`
+	Files  int `json:"files"`
+	Copied int `json:"copied"`
+}
+
+// The last line written to the JSON event log, once all source paths
+// have been processed.
+type summaryEvent struct {
+	Event string                `json:"event"`
+	Roots map[string]rootCounts `json:"roots,omitempty"`
+}
+
+// Opens path on the destination backend as a JSON-lines event log,
+// alongside the usual human-readable output.
+func parseJSONLog(ctx *backupContext, path string) {
+	path = strings.TrimSpace(path)
+	w, err := ctx.dst.Create(path, nil)
+	if err != nil {
+		msg(ctx, fmt.Sprint("Cannot open JSON log for writing: ", path))
+		return
+	}
+	ctx.jsonLog = w
+	ctx.jsonLogCloser = w
+	fmt.Fprintln(ctx.out, "JSON log", path)
+}
+
+// Appends v as one line to ctx.jsonLog, if a JSON log was enabled.
+// Safe to call from multiple worker goroutines.
+func emitJSON(ctx *backupContext, v any) {
+	if ctx.jsonLog == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	ctx.mu.Lock()
+	ctx.jsonLog.Write(data)
+	ctx.mu.Unlock()
+}
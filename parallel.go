@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// Returned by the walk callback to stop a directory walk early once a
+// worker has panicked (typically from hitting maxErrors); the concrete
+// error value is otherwise ignored by every Backend's WalkDir.
+var errStopWalk = errors.New("stopped")
+
+type fileJob struct {
+	path string
+	info fs.FileInfo
+}
+
+// Walks a source directory using a pool of ctx.parallelism worker
+// goroutines that each run the filter checks, stat, mkdirAll and copy
+// for a candidate file. Directory counts and collected messages are
+// serialized through ctx.mu, and progress-dot output is funneled
+// through a single goroutine via ctx.outCh so concurrent workers can't
+// interleave their writes.
+func handleDirParallel(ctx *backupContext, path string) {
+	jobs := make(chan fileJob, ctx.parallelism*4)
+
+	outCh := make(chan string, 16)
+	ctx.outCh = outCh
+	outDone := make(chan struct{})
+	go func() {
+		for s := range outCh {
+			fmt.Fprint(ctx.out, s)
+		}
+		close(outDone)
+	}()
+
+	var wg sync.WaitGroup
+	var stopMu sync.Mutex
+	var stopped bool
+	var panicVal any
+
+	stop := func() bool {
+		stopMu.Lock()
+		defer stopMu.Unlock()
+		return stopped
+	}
+
+	for i := 0; i < ctx.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					stopMu.Lock()
+					if !stopped {
+						stopped = true
+						panicVal = r
+					}
+					stopMu.Unlock()
+				}
+			}()
+			for j := range jobs {
+				if stop() {
+					continue
+				}
+				handleFile(ctx, j.path, j.info)
+			}
+		}()
+	}
+
+	walkCallback := func(p string, d fs.DirEntry, err error) error {
+		if stop() {
+			return errStopWalk
+		}
+		if d.IsDir() {
+			dirPath := p + string(filepath.Separator)
+			for _, rex := range ctx.exclude {
+				if rex.MatchString(dirPath) {
+					emitJSON(ctx, logEvent{Event: "skip", Src: dirPath, Reason: "excluded"})
+					return fs.SkipDir
+				}
+			}
+			ctx.mu.Lock()
+			ctx.count.dir++
+			ctx.mu.Unlock()
+		} else {
+			info, err := d.Info()
+			if err == nil {
+				jobs <- fileJob{p, info}
+			}
+		}
+		return nil
+	}
+	ctx.src.WalkDir(path, walkCallback)
+	close(jobs)
+	wg.Wait()
+
+	if ctx.count.files >= printDotFileCount {
+		writeOut(ctx, "\n")
+	}
+	writeOut(ctx, fmt.Sprintf("Dirs: %d, Files: %d, Copied: %d\n",
+		ctx.count.dir, ctx.count.files, ctx.count.copied))
+
+	close(outCh)
+	<-outDone
+	ctx.outCh = nil
+	recordRootSummary(ctx, path)
+
+	if panicVal != nil {
+		panic(panicVal)
+	}
+}
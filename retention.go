@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// One entry found while walking the destination for pruning.
+type destEntry struct {
+	path  string
+	isDir bool
+}
+
+// Removes destination files and directories under ctx.targetPath that
+// no longer correspond to any source path accepted in this run (per
+// ctx.seenDest), working deepest-first so a directory left empty by
+// its pruned children is itself considered for removal. Never touches
+// the digest manifest sidecar. Entries are listed in dry-run mode
+// instead of being removed.
+func pruneDestination(ctx *backupContext) {
+	var entries []destEntry
+	ctx.dst.WalkDir(ctx.targetPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == ctx.targetPath {
+			return nil
+		}
+		entries = append(entries, destEntry{p, d.IsDir()})
+		return nil
+	})
+
+	manifest := manifestPath(ctx.targetPath)
+	removed := map[string]bool{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.path == manifest {
+			continue
+		}
+		if e.isDir {
+			if hasSurvivingChild(entries, e.path, removed) {
+				continue
+			}
+		} else if _, seen := ctx.seenDest[e.path]; seen {
+			continue
+		}
+		removed[e.path] = true
+		prune(ctx, e.path, "prune")
+	}
+}
+
+// Reports whether any entry strictly under dir has not already been
+// marked for removal.
+func hasSurvivingChild(entries []destEntry, dir string, removed map[string]bool) bool {
+	prefix := dir + string(filepath.Separator)
+	for _, e := range entries {
+		if strings.HasPrefix(e.path, prefix) && !removed[e.path] {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletes snapshot directories directly under the parent of
+// ctx.targetPath beyond the ctx.keepSnapshots most recent, relying on
+// the "20060102-150405" timestamp format sorting lexicographically by
+// age.
+func pruneSnapshots(ctx *backupContext) {
+	base := filepath.Dir(ctx.targetPath)
+
+	var snapshots []string
+	ctx.dst.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == base {
+			return nil
+		}
+		if d.IsDir() {
+			snapshots = append(snapshots, p)
+			return fs.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(snapshots)
+
+	if len(snapshots) <= ctx.keepSnapshots {
+		return
+	}
+	for _, p := range snapshots[:len(snapshots)-ctx.keepSnapshots] {
+		prune(ctx, p, "prune snapshot")
+	}
+}
+
+// Removes path from the destination, or just reports it when dryRun.
+func prune(ctx *backupContext, path, label string) {
+	if ctx.dryRun {
+		writeOut(ctx, fmt.Sprintf("would %s: %s\n", label, path))
+		return
+	}
+	if err := ctx.dst.RemoveAll(path); err != nil {
+		msg(ctx, fmt.Sprintf("Cannot %s: %s", label, path))
+	}
+}